@@ -0,0 +1,28 @@
+// Copyright 2015 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kv
+
+import "fmt"
+
+// ErrDeleted indicates that a key was explicitly deleted at the wrapped
+// version, as opposed to having never been written. Store implementations
+// that distinguish tombstones from absent keys (e.g. hbasekv) return this
+// instead of ErrNotExist so callers doing federation or replication can
+// propagate the deletion rather than silently treating it as a miss.
+type ErrDeleted uint64
+
+// Error implements error.
+func (e ErrDeleted) Error() string {
+	return fmt.Sprintf("key deleted at version %d", uint64(e))
+}
@@ -14,6 +14,13 @@
 package hbasekv
 
 import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+
 	"github.com/juju/errors"
 	"github.com/ngaut/log"
 	"github.com/pingcap/go-hbase"
@@ -21,6 +28,18 @@ import (
 	"github.com/pingcap/tidb/kv"
 )
 
+// hbaseTombstoneQualifierBytes marks a cell as a tombstone rather than a
+// live value. Write paths elsewhere in the module persist this column,
+// stamped with the delete timestamp, instead of the value column when a key
+// is deleted, so readers can tell "never written" apart from "deleted at
+// version V".
+var hbaseTombstoneQualifierBytes = []byte("_del_")
+
+// hbaseTombstoneFmlAndQual is the family:qualifier key under which a
+// tombstone cell shows up in a hbase.ResultRow.Columns map, mirroring how
+// hbaseFmlAndQual addresses the value column.
+var hbaseTombstoneFmlAndQual = string(hbaseColFamilyBytes) + ":" + string(hbaseTombstoneQualifierBytes)
+
 var (
 	_ kv.Snapshot     = (*hbaseSnapshot)(nil)
 	_ kv.MvccSnapshot = (*hbaseSnapshot)(nil)
@@ -30,85 +49,509 @@ var (
 // hbaseBatchSize is used for go-themis Scanner.
 const hbaseBatchSize = 1000
 
+// defaultRangeQueryResultCap is how many (key, value, ts) tuples a single
+// RangeQueryInfo keeps verbatim before SetRangeQueryResultCap is ever
+// called. Once a scan exceeds its cap we stop retaining the tuples
+// themselves and rely solely on ResultHash for commit-time comparison, so
+// tracking a large scan doesn't pin its whole result set in memory.
+const defaultRangeQueryResultCap = 256
+
+// KVRead is a single (key, value, version) tuple observed while serving a
+// range scan. It is kept around, up to RangeQueryInfo's resultCap per scan,
+// so a commit-time validator can re-examine exactly what a transaction
+// read.
+type KVRead struct {
+	Key   kv.Key
+	Value []byte
+	Ver   uint64
+}
+
+// RangeQueryInfo records one range scan performed through a hbaseSnapshot.
+// An outer txn layer can replay the same [StartKey, EndKey) scan against a
+// later snapshot and compare ResultHash to detect phantom reads introduced
+// by writes that committed between the original scan and commit time.
+type RangeQueryInfo struct {
+	StartKey     kv.Key
+	EndKey       kv.Key
+	ItrExhausted bool
+	Results      []KVRead
+	ResultHash   []byte
+
+	resultCap int
+}
+
+// recordResult folds (key, value, ver) into the scan's rolling hash and, if
+// still under resultCap, appends it to Results so the raw tuple survives for
+// exact comparison.
+func (info *RangeQueryInfo) recordResult(key kv.Key, value []byte, ver uint64) {
+	if len(info.Results) < info.resultCap {
+		info.Results = append(info.Results, KVRead{
+			Key:   append(kv.Key(nil), key...),
+			Value: append([]byte(nil), value...),
+			Ver:   ver,
+		})
+	}
+	info.ResultHash = rollingRangeHash(info.ResultHash, key, value, ver)
+}
+
+// rollingRangeHash mixes one (key, value, ver) tuple into prev using a
+// Merkle-style incremental SHA-256: h = SHA256(prev || len(key) || key ||
+// len(val) || val || ver). This lets RangeQueryInfo summarize an arbitrarily
+// long scan in a fixed-size hash without retaining every tuple.
+func rollingRangeHash(prev []byte, key kv.Key, value []byte, ver uint64) []byte {
+	h := sha256.New()
+	h.Write(prev)
+	var lenBuf [8]byte
+	binary.BigEndian.PutUint32(lenBuf[0:4], uint32(len(key)))
+	h.Write(lenBuf[0:4])
+	h.Write(key)
+	binary.BigEndian.PutUint32(lenBuf[0:4], uint32(len(value)))
+	h.Write(lenBuf[0:4])
+	h.Write(value)
+	binary.BigEndian.PutUint64(lenBuf[:], ver)
+	h.Write(lenBuf[:])
+	return h.Sum(nil)
+}
+
+// maxBatchGetWorkers bounds how many BatchGet RPCs a single call to
+// hbaseSnapshot.BatchGet issues concurrently, so a very large key set
+// doesn't fan out an unbounded number of goroutines/RPCs at once.
+const maxBatchGetWorkers = 8
+
+// batchGetShardSize is the target number of keys per underlying BatchGet
+// RPC. Deduped keys are split into shards of roughly this size and the
+// shards are issued concurrently through the bounded worker pool.
+const batchGetShardSize = 128
+
+// defaultTombstoneCacheSize is the capacity a hbaseSnapshot's tombstone
+// cache starts with before any SetTombstoneCacheSize call.
+const defaultTombstoneCacheSize = 1024
+
+// tombstoneCacheTTL bounds how long a cached (storeName,key,ver) entry is
+// trusted before it's treated as a miss and re-fetched.
+const tombstoneCacheTTL = 5 * time.Minute
+
+// mvccCacheEntry is one cached MVCC read result: either a live value or a
+// tombstone recording the delete timestamp.
+type mvccCacheEntry struct {
+	key       string
+	value     []byte
+	deleted   bool
+	deleteTs  uint64
+	expiresAt time.Time
+}
+
+// mvccCache is a small FIFO cache keyed by (storeName, key, ver) that caches both
+// live values and tombstones for hbaseSnapshot's MVCC read path. Entries
+// are evicted in strict insertion order once the cache is over capacity, so
+// capacity is honored exactly regardless of access pattern.
+type mvccCache struct {
+	mu       sync.Mutex
+	capacity int
+	ll       *list.List
+	items    map[string]*list.Element
+}
+
+func newMvccCache(capacity int) *mvccCache {
+	return &mvccCache{
+		capacity: capacity,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+func mvccCacheKey(storeName string, key kv.Key, ver uint64) string {
+	return fmt.Sprintf("%s/%s/%d", storeName, key, ver)
+}
+
+func (c *mvccCache) get(key string) (mvccCacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return mvccCacheEntry{}, false
+	}
+	entry := el.Value.(*mvccCacheEntry)
+	if time.Now().After(entry.expiresAt) {
+		c.ll.Remove(el)
+		delete(c.items, key)
+		return mvccCacheEntry{}, false
+	}
+	return *entry, true
+}
+
+func (c *mvccCache) set(key string, entry mvccCacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		entry.key = key
+		el.Value = &entry
+		return
+	}
+	entry.key = key
+	el := c.ll.PushBack(&entry)
+	c.items[key] = el
+	for c.ll.Len() > c.capacity {
+		oldest := c.ll.Front()
+		if oldest == nil {
+			break
+		}
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*mvccCacheEntry).key)
+	}
+}
+
+// resolvedValue memoizes the outcome of resolving one key against the
+// underlying store: a live value, a known-missing key, or a tombstone.
+// exists distinguishes "known missing" from "unknown", so Get can return
+// kv.ErrNotExist straight from the cache without an RPC; deleted likewise
+// lets Get return kv.ErrDeleted without re-fetching a row it already knows
+// is a tombstone.
+type resolvedValue struct {
+	value    []byte
+	exists   bool
+	deleted  bool
+	deleteTs uint64
+}
+
 // hbaseSnapshot implements MvccSnapshot interface.
 type hbaseSnapshot struct {
 	txn       *themis.Txn
 	storeName string
+
+	rangeQueriesMu sync.Mutex
+	rangeQueries   []*RangeQueryInfo
+
+	resolvedMu sync.RWMutex
+	resolved   map[string]resolvedValue
+
+	// cfgMu guards rangeQueryResultCap, mvccCache and yieldTombstones: all
+	// three are set through exported setters that callers may use at any
+	// point during the snapshot's life, concurrently with MvccGet, range
+	// scans and iterator creation reading the same fields.
+	cfgMu               sync.RWMutex
+	rangeQueryResultCap int
+	mvccCache           *mvccCache
+	// yieldTombstones controls whether MvccIterators created from this
+	// snapshot surface tombstoned rows (true) or silently skip over them
+	// (the default, false).
+	yieldTombstones bool
+}
+
+// SetTombstoneVisibility controls whether MvccIterators created from this
+// snapshot yield tombstoned rows (mode=true) or skip over them as if they
+// didn't exist (the default).
+func (s *hbaseSnapshot) SetTombstoneVisibility(mode bool) {
+	s.cfgMu.Lock()
+	s.yieldTombstones = mode
+	s.cfgMu.Unlock()
+}
+
+func (s *hbaseSnapshot) tombstoneVisibility() bool {
+	s.cfgMu.RLock()
+	defer s.cfgMu.RUnlock()
+	return s.yieldTombstones
 }
 
 // newHBaseSnapshot creates a snapshot of an HBase store.
 func newHbaseSnapshot(txn *themis.Txn, storeName string) *hbaseSnapshot {
 	return &hbaseSnapshot{
-		txn:       txn,
-		storeName: storeName,
+		txn:                 txn,
+		storeName:           storeName,
+		resolved:            make(map[string]resolvedValue),
+		mvccCache:           newMvccCache(defaultTombstoneCacheSize),
+		rangeQueryResultCap: defaultRangeQueryResultCap,
+	}
+}
+
+// SetRangeQueryResultCap configures how many (key, value, ts) tuples a
+// RangeQueryInfo retains verbatim before falling back to hash-only
+// comparison. Only range scans started after this call are affected.
+func (s *hbaseSnapshot) SetRangeQueryResultCap(n int) {
+	s.cfgMu.Lock()
+	s.rangeQueryResultCap = n
+	s.cfgMu.Unlock()
+}
+
+func (s *hbaseSnapshot) currentRangeQueryResultCap() int {
+	s.cfgMu.RLock()
+	defer s.cfgMu.RUnlock()
+	return s.rangeQueryResultCap
+}
+
+// SetTombstoneCacheSize resizes the snapshot's MVCC value/tombstone cache.
+// A fresh, empty cache is installed at the new capacity.
+func (s *hbaseSnapshot) SetTombstoneCacheSize(n int) {
+	s.cfgMu.Lock()
+	s.mvccCache = newMvccCache(n)
+	s.cfgMu.Unlock()
+}
+
+func (s *hbaseSnapshot) currentMvccCache() *mvccCache {
+	s.cfgMu.RLock()
+	defer s.cfgMu.RUnlock()
+	return s.mvccCache
+}
+
+// cachedGet returns the memoized resolution for k, if any.
+func (s *hbaseSnapshot) cachedGet(k kv.Key) (resolvedValue, bool) {
+	s.resolvedMu.RLock()
+	v, ok := s.resolved[string(k)]
+	s.resolvedMu.RUnlock()
+	return v, ok
+}
+
+// cacheResolved memoizes the resolution of k so later Get/BatchGet calls on
+// this snapshot can short-circuit on it. RangeGet fills this cache but does
+// not read it: it always scans the store.
+func (s *hbaseSnapshot) cacheResolved(k kv.Key, v resolvedValue) {
+	s.resolvedMu.Lock()
+	s.resolved[string(k)] = v
+	s.resolvedMu.Unlock()
+}
+
+// dedupeKeys returns keys with duplicates removed, preserving first
+// occurrence order.
+func dedupeKeys(keys []kv.Key) []kv.Key {
+	seen := make(map[string]struct{}, len(keys))
+	out := make([]kv.Key, 0, len(keys))
+	for _, k := range keys {
+		sk := string(k)
+		if _, ok := seen[sk]; ok {
+			continue
+		}
+		seen[sk] = struct{}{}
+		out = append(out, k)
+	}
+	return out
+}
+
+// shardKeys splits keys into shards of at most shardSize keys each, used to
+// spread a single BatchGet across multiple concurrent RPCs.
+func shardKeys(keys []kv.Key, shardSize int) [][]kv.Key {
+	var shards [][]kv.Key
+	for shardSize < len(keys) {
+		shards = append(shards, keys[:shardSize])
+		keys = keys[shardSize:]
+	}
+	if len(keys) > 0 {
+		shards = append(shards, keys)
+	}
+	return shards
+}
+
+// newRangeQueryInfo starts tracking a new range scan over [start, end) and
+// registers it on the snapshot so RangeQueriesInfo() can return it later.
+func (s *hbaseSnapshot) newRangeQueryInfo(start, end kv.Key) *RangeQueryInfo {
+	info := &RangeQueryInfo{
+		StartKey:  append(kv.Key(nil), start...),
+		EndKey:    append(kv.Key(nil), end...),
+		resultCap: s.currentRangeQueryResultCap(),
 	}
+	s.rangeQueriesMu.Lock()
+	s.rangeQueries = append(s.rangeQueries, info)
+	s.rangeQueriesMu.Unlock()
+	return info
+}
+
+// RangeQueriesInfo returns every range scan recorded against this snapshot
+// so far, so an outer txn layer can replay them at commit time to validate
+// against phantom reads.
+func (s *hbaseSnapshot) RangeQueriesInfo() []*RangeQueryInfo {
+	s.rangeQueriesMu.Lock()
+	defer s.rangeQueriesMu.Unlock()
+	infos := make([]*RangeQueryInfo, len(s.rangeQueries))
+	copy(infos, s.rangeQueries)
+	return infos
 }
 
 // Get gets the value for key k from snapshot.
 func (s *hbaseSnapshot) Get(k kv.Key) ([]byte, error) {
+	if cached, ok := s.cachedGet(k); ok {
+		if cached.deleted {
+			return nil, errors.Trace(kv.ErrDeleted(cached.deleteTs))
+		}
+		if !cached.exists {
+			return nil, errors.Trace(kv.ErrNotExist)
+		}
+		return cached.value, nil
+	}
+
 	g := hbase.NewGet([]byte(k))
 	g.AddColumn(hbaseColFamilyBytes, hbaseQualifierBytes)
+	g.AddColumn(hbaseColFamilyBytes, hbaseTombstoneQualifierBytes)
 	v, err := internalGet(s, g)
 	if err != nil {
+		cause := errors.Cause(err)
+		if cause == kv.ErrNotExist {
+			s.cacheResolved(k, resolvedValue{exists: false})
+		} else if de, ok := cause.(kv.ErrDeleted); ok {
+			s.cacheResolved(k, resolvedValue{deleted: true, deleteTs: uint64(de)})
+		}
 		return nil, errors.Trace(err)
 	}
+	s.cacheResolved(k, resolvedValue{value: v, exists: true})
 	return v, nil
 }
 
-// BatchGet implements kv.Snapshot.BatchGet().
+// BatchGet implements kv.Snapshot.BatchGet(). It dedupes the input keys,
+// answers whatever it can from the snapshot's result cache, and shards the
+// remaining keys across batchGetShardSize-sized groups issued concurrently
+// through a pool of at most maxBatchGetWorkers workers.
 func (s *hbaseSnapshot) BatchGet(keys []kv.Key) (map[string][]byte, error) {
-	gets := make([]*hbase.Get, len(keys))
-	for i, key := range keys {
-		g := hbase.NewGet(key)
-		g.AddColumn(hbaseColFamilyBytes, hbaseQualifierBytes)
-		gets[i] = g
+	m := make(map[string][]byte, len(keys))
+
+	var missing []kv.Key
+	for _, k := range keys {
+		if cached, ok := s.cachedGet(k); ok {
+			if cached.exists {
+				m[string(k)] = cached.value
+			}
+			continue
+		}
+		missing = append(missing, k)
 	}
-	rows, err := s.txn.BatchGet(s.storeName, gets)
-	if err != nil {
-		return nil, errors.Trace(err)
+	if len(missing) == 0 {
+		return m, nil
 	}
 
-	m := make(map[string][]byte, len(rows))
-	for _, r := range rows {
-		k := string(r.Row)
-		v := r.Columns[hbaseFmlAndQual].Value
-		m[k] = v
+	unique := dedupeKeys(missing)
+	shards := shardKeys(unique, batchGetShardSize)
+
+	type shardResult struct {
+		rows []*hbase.ResultRow
+		err  error
+	}
+	results := make([]shardResult, len(shards))
+	sem := make(chan struct{}, maxBatchGetWorkers)
+	var wg sync.WaitGroup
+	for i, shard := range shards {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, shard []kv.Key) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			gets := make([]*hbase.Get, len(shard))
+			for j, key := range shard {
+				g := hbase.NewGet(key)
+				g.AddColumn(hbaseColFamilyBytes, hbaseQualifierBytes)
+				g.AddColumn(hbaseColFamilyBytes, hbaseTombstoneQualifierBytes)
+				gets[j] = g
+			}
+			rows, err := s.txn.BatchGet(s.storeName, gets)
+			results[i] = shardResult{rows: rows, err: err}
+		}(i, shard)
+	}
+	wg.Wait()
+
+	found := make(map[string][]byte, len(unique))
+	deleted := make(map[string]uint64)
+	for _, res := range results {
+		if res.err != nil {
+			return nil, errors.Trace(res.err)
+		}
+		for _, r := range res.rows {
+			if tomb, ok := r.Columns[hbaseTombstoneFmlAndQual]; ok {
+				deleted[string(r.Row)] = tomb.Ts
+				continue
+			}
+			found[string(r.Row)] = r.Columns[hbaseFmlAndQual].Value
+		}
+	}
+
+	for _, k := range unique {
+		sk := string(k)
+		if v, ok := found[sk]; ok {
+			s.cacheResolved(k, resolvedValue{value: v, exists: true})
+			m[sk] = v
+		} else if ts, ok := deleted[sk]; ok {
+			s.cacheResolved(k, resolvedValue{deleted: true, deleteTs: ts})
+		} else {
+			s.cacheResolved(k, resolvedValue{exists: false})
+		}
 	}
 	return m, nil
 }
 
+// PrefetchKeys fires BatchGet for keys in the background so the snapshot's
+// result cache is already warm by the time the executor actually needs
+// them, e.g. while the rest of a plan is still being built.
+func (s *hbaseSnapshot) PrefetchKeys(keys []kv.Key) {
+	go func() {
+		if _, err := s.BatchGet(keys); err != nil {
+			log.Warnf("hbase prefetch keys failed: %v", err)
+		}
+	}()
+}
+
 // RangeGet implements kv.Snapshot.RangeGet().
 // The range should be [start, end] as Snapshot.RangeGet() indicated.
 func (s *hbaseSnapshot) RangeGet(start, end kv.Key, limit int) (map[string][]byte, error) {
 	scanner := s.txn.GetScanner([]byte(s.storeName), start, end, limit)
 	defer scanner.Close()
 
+	info := s.newRangeQueryInfo(start, end)
+
+	// Tombstoned rows are tracked (for the phantom-read hash) but don't
+	// count against limit, so they don't crowd out live rows further along
+	// the range the way a plain row-count loop would.
 	m := make(map[string][]byte)
-	for i := 0; i < limit; i++ {
+	for len(m) < limit {
 		r := scanner.Next()
-		if r != nil && len(r.Columns) > 0 {
-			k := string(r.Row)
-			v := r.Columns[hbaseFmlAndQual].Value
-			m[k] = v
-		} else {
+		if r == nil || len(r.Columns) == 0 {
+			info.ItrExhausted = true
 			break
 		}
+		if tomb, ok := r.Columns[hbaseTombstoneFmlAndQual]; ok {
+			info.recordResult(kv.Key(r.Row), nil, tomb.Ts)
+			s.cacheResolved(kv.Key(r.Row), resolvedValue{deleted: true, deleteTs: tomb.Ts})
+			continue
+		}
+		k := string(r.Row)
+		col := r.Columns[hbaseFmlAndQual]
+		m[k] = col.Value
+		info.recordResult(kv.Key(r.Row), col.Value, col.Ts)
+		s.cacheResolved(kv.Key(r.Row), resolvedValue{value: col.Value, exists: true})
 	}
 
 	return m, nil
 }
 
 // MvccGet returns the specific version of given key, if the version doesn't
-// exist, returns the nearest(lower) version's data.
+// exist, returns the nearest(lower) version's data. If that version was a
+// delete, it returns kv.ErrDeleted wrapping the delete timestamp instead of
+// silently behaving like the key was never written.
 func (s *hbaseSnapshot) MvccGet(k kv.Key, ver kv.Version) ([]byte, error) {
+	cache := s.currentMvccCache()
+	cacheKey := mvccCacheKey(s.storeName, k, ver.Ver)
+	if entry, ok := cache.get(cacheKey); ok {
+		if entry.deleted {
+			return nil, errors.Trace(kv.ErrDeleted(entry.deleteTs))
+		}
+		return entry.value, nil
+	}
+
 	g := hbase.NewGet([]byte(k))
 	g.AddColumn(hbaseColFamilyBytes, hbaseQualifierBytes)
+	g.AddColumn(hbaseColFamilyBytes, hbaseTombstoneQualifierBytes)
 	g.TsRangeFrom = 0
 	g.TsRangeTo = ver.Ver + 1
 	v, err := internalGet(s, g)
 	if err != nil {
+		if de, ok := errors.Cause(err).(kv.ErrDeleted); ok {
+			cache.set(cacheKey, mvccCacheEntry{
+				deleted:   true,
+				deleteTs:  uint64(de),
+				expiresAt: time.Now().Add(tombstoneCacheTTL),
+			})
+		}
 		return nil, errors.Trace(err)
 	}
+	cache.set(cacheKey, mvccCacheEntry{
+		value:     v,
+		expiresAt: time.Now().Add(tombstoneCacheTTL),
+	})
 	return v, nil
 }
 
@@ -120,7 +563,14 @@ func internalGet(s *hbaseSnapshot, g *hbase.Get) ([]byte, error) {
 	if r == nil || len(r.Columns) == 0 {
 		return nil, errors.Trace(kv.ErrNotExist)
 	}
-	return r.Columns[hbaseFmlAndQual].Value, nil
+	if tomb, ok := r.Columns[hbaseTombstoneFmlAndQual]; ok {
+		return nil, errors.Trace(kv.ErrDeleted(tomb.Ts))
+	}
+	col, ok := r.Columns[hbaseFmlAndQual]
+	if !ok {
+		return nil, errors.Trace(kv.ErrNotExist)
+	}
+	return col.Value, nil
 }
 
 func (s *hbaseSnapshot) NewIterator(param interface{}) kv.Iterator {
@@ -131,20 +581,162 @@ func (s *hbaseSnapshot) NewIterator(param interface{}) kv.Iterator {
 	}
 
 	scanner := s.txn.GetScanner([]byte(s.storeName), k, nil, hbaseBatchSize)
-	return newInnerScanner(scanner)
+	info := s.newRangeQueryInfo(kv.Key(k), nil)
+	return newInnerScanner(innerScannerConfig{
+		scanner:         scanner,
+		info:            info,
+		yieldTombstones: s.tombstoneVisibility(),
+	})
 }
 
 // MvccIterator seeks to the key in the specific version's snapshot, if the
 // version doesn't exist, returns the nearest(lower) version's snaphot.
 func (s *hbaseSnapshot) NewMvccIterator(k kv.Key, ver kv.Version) kv.Iterator {
-	scanner := s.txn.GetScanner([]byte(s.storeName), k, nil, hbaseBatchSize)
-	scanner.SetTimeRange(0, ver.Ver+1)
-	return newInnerScanner(scanner)
+	return s.NewMvccIteratorOpts(MvccIterOpts{
+		StartKey: k,
+		TsLow:    0,
+		TsHigh:   ver.Ver + 1,
+	})
+}
+
+// rowScanner is the minimal scanning surface hbaseIter needs. It's
+// implemented directly by *themis.ThemisScanner for forward scans, and by
+// reverseScanner for the buffered reverse-scan wrapper below, so hbaseIter
+// doesn't need to care which direction it's walking.
+type rowScanner interface {
+	Next() *hbase.ResultRow
+	Close()
+	Closed() bool
 }
 
-func newInnerScanner(scanner *themis.ThemisScanner) kv.Iterator {
+// maxReverseScanBufferRows bounds how many rows reverseScanner will buffer
+// before giving up. NewMvccIteratorOpts already rejects Reverse scans with
+// a nil EndKey, which is the main way a reverse scan could be unbounded;
+// this is a second line of defense against a bounded-looking range that
+// still turns out to hold more rows than anyone intended to buffer.
+const maxReverseScanBufferRows = 1 << 20
+
+// reverseScanner adapts a forward-only themis.ThemisScanner into a
+// reverse-iteration view. go-themis scanners don't support server-side
+// reverse scans, so this wrapper drains the forward scan into memory once
+// and then replays the buffered rows back-to-front. This trades memory for
+// correctness and is only appropriate for the bounded [StartKey, EndKey)
+// ranges MvccIterOpts.Reverse is meant for, not unbounded scans.
+type reverseScanner struct {
+	rows   []*hbase.ResultRow
+	pos    int
+	closed bool
+}
+
+func newReverseScanner(inner *themis.ThemisScanner) *reverseScanner {
+	var rows []*hbase.ResultRow
+	for {
+		r := inner.Next()
+		if r == nil || len(r.Columns) == 0 {
+			break
+		}
+		rows = append(rows, r)
+		if len(rows) > maxReverseScanBufferRows {
+			log.Errorf("hbase reverse scan buffered over %d rows, aborting", maxReverseScanBufferRows)
+			break
+		}
+	}
+	inner.Close()
+	return &reverseScanner{rows: rows, pos: len(rows)}
+}
+
+func (r *reverseScanner) Next() *hbase.ResultRow {
+	if r.closed || r.pos == 0 {
+		return nil
+	}
+	r.pos--
+	return r.rows[r.pos]
+}
+
+func (r *reverseScanner) Close() {
+	r.closed = true
+}
+
+func (r *reverseScanner) Closed() bool {
+	return r.closed
+}
+
+// MvccIterOpts configures an MVCC range scan: the [StartKey, EndKey) range
+// to cover (EndKey nil means "to end of store"), the scan direction, the
+// [TsLow, TsHigh) version window to consider, and whether every historical
+// version of a key within that window should be surfaced rather than just
+// the latest one. It lets callers implement point-in-time diff / CDC-style
+// reads ("what versions of keys in [a,b) existed between T1 and T2") that
+// NewMvccIterator's single forward scan to end-of-store can't express.
+type MvccIterOpts struct {
+	StartKey           kv.Key
+	EndKey             kv.Key
+	Reverse            bool
+	TsLow              uint64
+	TsHigh             uint64
+	IncludeAllVersions bool
+}
+
+// NewMvccIteratorOpts creates an MvccIterator as described by opts. When
+// opts.IncludeAllVersions is set, successive Next() calls walk every
+// historical cell of a key within [TsLow, TsHigh), newest to oldest, before
+// advancing to the next row, instead of collapsing straight to the latest
+// version; Version() reports which version the iterator is currently
+// positioned at.
+//
+// opts.Reverse requires a non-nil opts.EndKey: reverseScanner must buffer
+// the whole [StartKey, EndKey) range in memory before it can replay it
+// back-to-front, so a nil EndKey ("to end of store") would buffer an
+// unbounded number of rows. Callers that need a reverse scan must bound it
+// explicitly.
+func (s *hbaseSnapshot) NewMvccIteratorOpts(opts MvccIterOpts) kv.Iterator {
+	if opts.Reverse && opts.EndKey == nil {
+		log.Errorf("hbase reverse mvcc iterator requires a bounded EndKey, got nil")
+		return nil
+	}
+
+	themisScanner := s.txn.GetScanner([]byte(s.storeName), opts.StartKey, opts.EndKey, hbaseBatchSize)
+	themisScanner.SetTimeRange(opts.TsLow, opts.TsHigh)
+
+	var scanner rowScanner = themisScanner
+	if opts.Reverse {
+		scanner = newReverseScanner(themisScanner)
+	}
+
+	info := s.newRangeQueryInfo(opts.StartKey, opts.EndKey)
+	return newInnerScanner(innerScannerConfig{
+		scanner:            scanner,
+		info:               info,
+		yieldTombstones:    s.tombstoneVisibility(),
+		includeAllVersions: opts.IncludeAllVersions,
+		snapshot:           s,
+		tsLow:              opts.TsLow,
+		tsHigh:             opts.TsHigh,
+	})
+}
+
+// innerScannerConfig bundles the state newInnerScanner needs to build a
+// hbaseIter; includeAllVersions/snapshot/tsLow/tsHigh are only used by
+// NewMvccIteratorOpts, plain scans leave them at their zero values.
+type innerScannerConfig struct {
+	scanner            rowScanner
+	info               *RangeQueryInfo
+	yieldTombstones    bool
+	includeAllVersions bool
+	snapshot           *hbaseSnapshot
+	tsLow              uint64
+	tsHigh             uint64
+}
+
+func newInnerScanner(cfg innerScannerConfig) kv.Iterator {
 	it := &hbaseIter{
-		ThemisScanner: scanner,
+		scanner:            cfg.scanner,
+		info:               cfg.info,
+		yieldTombstones:    cfg.yieldTombstones,
+		includeAllVersions: cfg.includeAllVersions,
+		snapshot:           cfg.snapshot,
+		tsLow:              cfg.tsLow,
+		nextTsHigh:         cfg.tsHigh,
 	}
 	it.Next()
 	return it
@@ -163,20 +755,92 @@ func (s *hbaseSnapshot) MvccRelease() {
 }
 
 type hbaseIter struct {
-	*themis.ThemisScanner
-	rs *hbase.ResultRow
+	scanner rowScanner
+	rs      *hbase.ResultRow
+	info    *RangeQueryInfo
+
+	// yieldTombstones controls whether Next() surfaces tombstoned rows or
+	// silently skips past them to the next live row.
+	yieldTombstones bool
+
+	// includeAllVersions, snapshot, tsLow and nextTsHigh implement walking
+	// every historical version of the current row (newest to oldest, within
+	// [tsLow, nextTsHigh)) before the underlying scanner advances to the
+	// next row. snapshot is needed because the scanner itself only ever
+	// returns one version per row; older versions of the same row are
+	// fetched with direct Gets that narrow TsRangeTo each time.
+	includeAllVersions bool
+	snapshot           *hbaseSnapshot
+	tsLow              uint64
+	nextTsHigh         uint64
 }
 
 func (it *hbaseIter) Next() error {
-	it.rs = it.ThemisScanner.Next()
-	return nil
+	for {
+		if it.includeAllVersions && it.rs != nil && len(it.rs.Columns) > 0 && it.nextTsHigh > it.tsLow {
+			if older := it.fetchOlderVersion(kv.Key(it.rs.Row)); older != nil {
+				it.rs = older
+				it.nextTsHigh = it.Version()
+				if it.recordAndShouldSkip() {
+					continue
+				}
+				return nil
+			}
+		}
+
+		it.rs = it.scanner.Next()
+		if it.rs == nil || len(it.rs.Columns) == 0 {
+			if it.info != nil {
+				it.info.ItrExhausted = true
+			}
+			return nil
+		}
+		it.nextTsHigh = it.Version()
+		if it.recordAndShouldSkip() {
+			continue
+		}
+		return nil
+	}
+}
+
+// fetchOlderVersion looks up the next older version of key, strictly below
+// nextTsHigh and no older than tsLow. It returns nil once no earlier
+// version of key exists in that window.
+func (it *hbaseIter) fetchOlderVersion(key kv.Key) *hbase.ResultRow {
+	if it.snapshot == nil {
+		return nil
+	}
+	g := hbase.NewGet([]byte(key))
+	g.AddColumn(hbaseColFamilyBytes, hbaseQualifierBytes)
+	g.AddColumn(hbaseColFamilyBytes, hbaseTombstoneQualifierBytes)
+	g.TsRangeFrom = it.tsLow
+	g.TsRangeTo = it.nextTsHigh
+	r, err := it.snapshot.txn.Get(it.snapshot.storeName, g)
+	if err != nil || r == nil || len(r.Columns) == 0 {
+		return nil
+	}
+	return r
+}
+
+// recordAndShouldSkip records the current row into info, if tracked, and
+// reports whether Next() should keep looking because the row is a
+// tombstone being hidden from the caller.
+func (it *hbaseIter) recordAndShouldSkip() bool {
+	if it.info != nil {
+		if tomb, ok := it.rs.Columns[hbaseTombstoneFmlAndQual]; ok {
+			it.info.recordResult(kv.Key(it.rs.Row), nil, tomb.Ts)
+		} else if col, ok := it.rs.Columns[hbaseFmlAndQual]; ok {
+			it.info.recordResult(kv.Key(it.rs.Row), col.Value, col.Ts)
+		}
+	}
+	return it.Deleted() && !it.yieldTombstones
 }
 
 func (it *hbaseIter) Valid() bool {
 	if it.rs == nil || len(it.rs.Columns) == 0 {
 		return false
 	}
-	if it.ThemisScanner.Closed() {
+	if it.scanner != nil && it.scanner.Closed() {
 		return false
 	}
 	return true
@@ -190,10 +854,38 @@ func (it *hbaseIter) Value() []byte {
 	return it.rs.Columns[hbaseFmlAndQual].Value
 }
 
+// Deleted reports whether the current row is a tombstone rather than a live
+// value.
+func (it *hbaseIter) Deleted() bool {
+	if it.rs == nil {
+		return false
+	}
+	_, ok := it.rs.Columns[hbaseTombstoneFmlAndQual]
+	return ok
+}
+
+// Version returns the HBase timestamp of the cell Key()/Value() currently
+// point to. It's only meaningful when the iterator was created with
+// MvccIterOpts.IncludeAllVersions set, where Key() can repeat across
+// successive Next() calls as the iterator walks each historical version of
+// that key.
+func (it *hbaseIter) Version() uint64 {
+	if it.rs == nil {
+		return 0
+	}
+	if col, ok := it.rs.Columns[hbaseFmlAndQual]; ok {
+		return col.Ts
+	}
+	if tomb, ok := it.rs.Columns[hbaseTombstoneFmlAndQual]; ok {
+		return tomb.Ts
+	}
+	return 0
+}
+
 func (it *hbaseIter) Close() {
-	if it.ThemisScanner != nil {
-		it.ThemisScanner.Close()
-		it.ThemisScanner = nil
+	if it.scanner != nil {
+		it.scanner.Close()
+		it.scanner = nil
 	}
 	it.rs = nil
 }
@@ -0,0 +1,170 @@
+// Copyright 2015 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hbasekv
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/pingcap/tidb/kv"
+)
+
+func TestDedupeKeys(t *testing.T) {
+	keys := []kv.Key{kv.Key("a"), kv.Key("b"), kv.Key("a"), kv.Key("c"), kv.Key("b")}
+	got := dedupeKeys(keys)
+	want := []string{"a", "b", "c"}
+	if len(got) != len(want) {
+		t.Fatalf("dedupeKeys(%v) = %v, want %v", keys, got, want)
+	}
+	for i, k := range got {
+		if string(k) != want[i] {
+			t.Fatalf("dedupeKeys(%v) = %v, want %v", keys, got, want)
+		}
+	}
+}
+
+func TestShardKeys(t *testing.T) {
+	keys := genKeys(10)
+	shards := shardKeys(keys, 3)
+	if len(shards) != 4 {
+		t.Fatalf("shardKeys: got %d shards, want 4", len(shards))
+	}
+	var total int
+	for i, shard := range shards {
+		if i < 3 && len(shard) != 3 {
+			t.Fatalf("shard %d has %d keys, want 3", i, len(shard))
+		}
+		total += len(shard)
+	}
+	if total != len(keys) {
+		t.Fatalf("shardKeys dropped keys: got %d total, want %d", total, len(keys))
+	}
+}
+
+func TestShardKeysEmpty(t *testing.T) {
+	if shards := shardKeys(nil, 3); shards != nil {
+		t.Fatalf("shardKeys(nil, 3) = %v, want nil", shards)
+	}
+}
+
+func TestRollingRangeHashDeterministic(t *testing.T) {
+	h1 := rollingRangeHash(nil, kv.Key("k1"), []byte("v1"), 1)
+	h1 = rollingRangeHash(h1, kv.Key("k2"), []byte("v2"), 2)
+
+	h2 := rollingRangeHash(nil, kv.Key("k1"), []byte("v1"), 1)
+	h2 = rollingRangeHash(h2, kv.Key("k2"), []byte("v2"), 2)
+
+	if string(h1) != string(h2) {
+		t.Fatalf("rollingRangeHash not deterministic: %x != %x", h1, h2)
+	}
+
+	h3 := rollingRangeHash(nil, kv.Key("k2"), []byte("v2"), 2)
+	h3 = rollingRangeHash(h3, kv.Key("k1"), []byte("v1"), 1)
+	if string(h1) == string(h3) {
+		t.Fatalf("rollingRangeHash should be order-sensitive, got equal hashes for reversed input")
+	}
+}
+
+func TestMvccCacheStrictInsertionOrderEviction(t *testing.T) {
+	c := newMvccCache(2)
+	c.set("a", mvccCacheEntry{value: []byte("1"), expiresAt: time.Now().Add(time.Hour)})
+	c.set("b", mvccCacheEntry{value: []byte("2"), expiresAt: time.Now().Add(time.Hour)})
+
+	// Touching "a" must not save it from eviction: the cache evicts in
+	// strict insertion order, not LRU-by-access order.
+	if _, ok := c.get("a"); !ok {
+		t.Fatalf("expected a to be present before eviction")
+	}
+	c.set("c", mvccCacheEntry{value: []byte("3"), expiresAt: time.Now().Add(time.Hour)})
+
+	if _, ok := c.get("a"); ok {
+		t.Fatalf("expected a to be evicted in insertion order despite being read")
+	}
+	if _, ok := c.get("b"); !ok {
+		t.Fatalf("expected b to still be present")
+	}
+	if _, ok := c.get("c"); !ok {
+		t.Fatalf("expected c to be present")
+	}
+}
+
+func TestMvccCacheExpiry(t *testing.T) {
+	c := newMvccCache(10)
+	c.set("a", mvccCacheEntry{value: []byte("1"), expiresAt: time.Now().Add(-time.Second)})
+	if _, ok := c.get("a"); ok {
+		t.Fatalf("expected expired entry to be treated as a miss")
+	}
+}
+
+func genKeys(n int) []kv.Key {
+	keys := make([]kv.Key, n)
+	for i := range keys {
+		keys[i] = kv.Key(fmt.Sprintf("key-%06d", i))
+	}
+	return keys
+}
+
+// serialDedupe is the naive, allocation-heavy dedup a serial BatchGet path
+// would use: an O(n^2) membership scan, kept here only as a benchmark
+// baseline for dedupeKeys.
+func serialDedupe(keys []kv.Key) []kv.Key {
+	var out []kv.Key
+	for _, k := range keys {
+		found := false
+		for _, o := range out {
+			if string(o) == string(k) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			out = append(out, k)
+		}
+	}
+	return out
+}
+
+func benchmarkDedupeKeys(b *testing.B, n int) {
+	keys := genKeys(n)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		dedupeKeys(keys)
+	}
+}
+
+func BenchmarkDedupeKeys1k(b *testing.B)  { benchmarkDedupeKeys(b, 1000) }
+func BenchmarkDedupeKeys10k(b *testing.B) { benchmarkDedupeKeys(b, 10000) }
+
+func benchmarkSerialDedupe(b *testing.B, n int) {
+	keys := genKeys(n)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		serialDedupe(keys)
+	}
+}
+
+func BenchmarkSerialDedupe1k(b *testing.B)  { benchmarkSerialDedupe(b, 1000) }
+func BenchmarkSerialDedupe10k(b *testing.B) { benchmarkSerialDedupe(b, 10000) }
+
+func benchmarkShardKeys(b *testing.B, n int) {
+	keys := genKeys(n)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		shardKeys(keys, batchGetShardSize)
+	}
+}
+
+func BenchmarkShardKeys1k(b *testing.B)  { benchmarkShardKeys(b, 1000) }
+func BenchmarkShardKeys10k(b *testing.B) { benchmarkShardKeys(b, 10000) }